@@ -15,8 +15,13 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -24,6 +29,7 @@ import (
 	"sort"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	descriptor "github.com/golang/protobuf/protoc-gen-go/descriptor"
@@ -31,6 +37,11 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"gopkg.in/yaml.v2"
 )
 
 var tmpl = template.Must(template.New("grpc json transcoder filter").Parse(
@@ -39,17 +50,23 @@ apiVersion: networking.istio.io/v1alpha3
 kind: EnvoyFilter
 metadata:
   name: {{ .ServiceName }}
+  {{ if eq .Context "GATEWAY" }}# virtualHost: this filter is intended for traffic addressed to host {{ .Host }}; the
+  # host is not matched below, since EnvoyFilter's HTTP_FILTER patches cannot be scoped to a virtual host,
+  # so the filter transcodes traffic for every virtual host on the matched gateway listener.
+  {{ end -}}
 spec:
   workloadSelector:
     labels:
-      app: {{ .ServiceName }}
+      {{ range $k, $v := .SelectorLabels }}{{ $k }}: {{ $v }}
+      {{ end -}}
   configPatches:
     # The first patch adds the grpc_json_transcoder filter to the listener/http connection manager
   - applyTo: HTTP_FILTER
     match:
-      context: SIDECAR_INBOUND
+      context: {{ .Context }}
       listener:
-        portNumber: {{ .PortNumber }}
+        {{ if eq .Context "SIDECAR_INBOUND" }}portNumber: {{ .PortNumber }}
+        {{ end -}}
         filterChain:
           filter:
             name: envoy.filters.network.http_connection_manager
@@ -65,22 +82,441 @@ spec:
           proto_descriptor_bin: {{ .DescriptorBinary }}
           services: {{ range .ProtoServices }}
           - {{ . }}{{end}}
-          match_incoming_request_route: true
-          ignore_unknown_query_parameters: true
-          ignored_query_parameters: []
+          match_incoming_request_route: {{ .MatchIncomingRequestRoute }}
+          ignore_unknown_query_parameters: {{ .IgnoreUnknownQueryParameters }}
+          ignored_query_parameters: [{{ range $i, $p := .IgnoredQueryParameters }}{{ if $i }}, {{ end }}"{{ $p }}"{{ end }}]
           convert_grpc_status: {{ .ConvertGRPCStatus }}
-          auto_mapping: false
+          auto_mapping: {{ .AutoMapping }}
+          {{ if .MaxRequestBodySize }}max_request_body_size: {{ .MaxRequestBodySize }}
+          {{ end -}}
+          {{ if .MaxResponseBodySize }}max_response_body_size: {{ .MaxResponseBodySize }}
+          {{ end -}}
           print_options:
             add_whitespace: {{ .AddWhiteSpace }}
-            always_print_primitive_fields: true
-            always_print_enums_as_ints: false
-            preserve_proto_field_names: false
+            always_print_primitive_fields: {{ .AlwaysPrintPrimitiveFields }}
+            always_print_enums_as_ints: {{ .PrintEnumsAsInts }}
+            preserve_proto_field_names: {{ .PreserveProtoFieldNames }}
 ---
 `))
 
+// configMapTmpl is used instead of tmpl when --output-mode=configmap: the descriptor is too large (or the
+// operator otherwise prefers it) to inline as base64 directly in the EnvoyFilter CRD, so it is shipped as one or
+// more ConfigMaps and mounted into the sidecar instead.
+var configMapTmpl = template.Must(template.New("grpc json transcoder filter (configmap)").Parse(
+	`# Created by github.com/tetratelabs/istio-tools/grpc-transcoder
+{{ range .ConfigMaps }}apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Name }}
+binaryData:
+  {{ $.DescriptorKey }}: {{ .Data }}
+---
+{{ end -}}
+apiVersion: networking.istio.io/v1alpha3
+kind: EnvoyFilter
+metadata:
+  name: {{ .ServiceName }}
+  annotations:
+    {{ if eq .Context "GATEWAY" -}}
+    # virtualHost: this filter is intended for traffic addressed to host {{ .Host }}; the host is not
+    # matched below, since EnvoyFilter's HTTP_FILTER patches cannot be scoped to a virtual host, so the
+    # filter transcodes traffic for every virtual host on the matched gateway listener.
+    {{ end -}}
+    # NOTE: EnvoyFilter can only patch Envoy xDS config, not the workload's Pod spec, so these volume
+    # annotations must be copied onto the target Deployment's pod template for the sidecar injector to
+    # mount them. See https://istio.io/latest/docs/reference/config/annotations/#SidecarUserVolume
+    sidecar.istio.io/userVolume: '[{{ range $i, $cm := .ConfigMaps }}{{ if $i }},{{ end }}{"name":"{{ $cm.Name }}","configMap":{"name":"{{ $cm.Name }}"}}{{ end }}]'
+    sidecar.istio.io/userVolumeMount: '[{{ range $i, $cm := .ConfigMaps }}{{ if $i }},{{ end }}{"name":"{{ $cm.Name }}","mountPath":"{{ if eq (len $.ConfigMaps) 1 }}{{ $.MountPath }}{{ else }}{{ $.MountPath }}/{{ $cm.Name }}{{ end }}"}{{ end }}]'
+    {{ if gt (len .ConfigMaps) 1 }}# NOTE: the descriptor was split across multiple ConfigMaps because it exceeds a single
+    # ConfigMap's size ceiling; add an init container to the workload that concatenates the mounted
+    # chunks (in name order) into {{ .MountPath }}/{{ .DescriptorKey }} before the sidecar starts.
+    {{ end -}}
+spec:
+  workloadSelector:
+    labels:
+      {{ range $k, $v := .SelectorLabels }}{{ $k }}: {{ $v }}
+      {{ end -}}
+  configPatches:
+    # The first patch adds the grpc_json_transcoder filter to the listener/http connection manager
+  - applyTo: HTTP_FILTER
+    match:
+      context: {{ .Context }}
+      listener:
+        {{ if eq .Context "SIDECAR_INBOUND" }}portNumber: {{ .PortNumber }}
+        {{ end -}}
+        filterChain:
+          filter:
+            name: envoy.filters.network.http_connection_manager
+            subFilter:
+              name: envoy.filters.http.router
+    patch:
+      operation: INSERT_BEFORE
+      value: # grpc-json filter specification
+        name: envoy.filters.http.grpc_json_transcoder
+        typed_config: # https://www.envoyproxy.io/docs/envoy/latest/configuration/http/http_filters/grpc_json_transcoder_filter#config-http-filters-grpc-json-transcoder
+          "@type": type.googleapis.com/envoy.extensions.filters.http.grpc_json_transcoder.v3.GrpcJsonTranscoder
+          # proto_descriptor: the path the ConfigMap(s) above are mounted at, rather than an inline blob.
+          proto_descriptor: {{ .MountPath }}/{{ .DescriptorKey }}
+          services: {{ range .ProtoServices }}
+          - {{ . }}{{end}}
+          match_incoming_request_route: {{ .MatchIncomingRequestRoute }}
+          ignore_unknown_query_parameters: {{ .IgnoreUnknownQueryParameters }}
+          ignored_query_parameters: [{{ range $i, $p := .IgnoredQueryParameters }}{{ if $i }}, {{ end }}"{{ $p }}"{{ end }}]
+          convert_grpc_status: {{ .ConvertGRPCStatus }}
+          auto_mapping: {{ .AutoMapping }}
+          {{ if .MaxRequestBodySize }}max_request_body_size: {{ .MaxRequestBodySize }}
+          {{ end -}}
+          {{ if .MaxResponseBodySize }}max_response_body_size: {{ .MaxResponseBodySize }}
+          {{ end -}}
+          print_options:
+            add_whitespace: {{ .AddWhiteSpace }}
+            always_print_primitive_fields: {{ .AlwaysPrintPrimitiveFields }}
+            always_print_enums_as_ints: {{ .PrintEnumsAsInts }}
+            preserve_proto_field_names: {{ .PreserveProtoFieldNames }}
+---
+`))
+
+// grpcGatewayTmpl backs --output-mode=grpc-gateway: instead of an EnvoyFilter, it stands up a small
+// grpc-gateway reverse proxy Deployment in front of the upstream gRPC service, for meshes/sidecars that
+// can't rely on Envoy's own grpc_json_transcoder filter.
+var grpcGatewayTmpl = template.Must(template.New("grpc-gateway proxy").Funcs(template.FuncMap{"indent": indentLines}).Parse(
+	`# Created by github.com/tetratelabs/istio-tools/grpc-transcoder
+{{ range .ConfigMaps }}apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Name }}
+binaryData:
+  {{ $.DescriptorKey }}: {{ .Data }}
+---
+{{ end -}}
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .ServiceName }}-routes
+data:
+  # routes.json: the google.api.http bindings this tool could derive from the descriptor, for the proxy image
+  # to map HTTP/JSON requests onto gRPC calls without its own compiled stubs. Methods without an annotation
+  # fall back to POST /package.Service/Method.
+  routes.json: |
+{{ indent 4 .RoutesJSON }}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ .ServiceName }}-grpc-gateway
+  labels:
+    app: {{ .ServiceName }}-grpc-gateway
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: {{ .ServiceName }}-grpc-gateway
+  template:
+    metadata:
+      labels:
+        app: {{ .ServiceName }}-grpc-gateway
+    spec:
+      {{ if gt (len .ConfigMaps) 1 -}}
+      # The descriptor was split across multiple ConfigMaps (see grpc-transcoder --output-mode=configmap); unlike
+      # EnvoyFilter, this Deployment owns its own Pod spec, so it can concatenate them with an init container
+      # instead of requiring the operator to do it by hand.
+      initContainers:
+      - name: assemble-descriptor
+        image: busybox
+        command: ["sh", "-c", "cat {{ .MountPath }}/parts/part-*.pb > {{ .MountPath }}/{{ .DescriptorKey }}"]
+        volumeMounts:
+        - name: descriptor-parts
+          mountPath: {{ .MountPath }}/parts
+        - name: descriptor
+          mountPath: {{ .MountPath }}
+      {{ end -}}
+      containers:
+      - name: grpc-gateway
+        image: {{ .Image }}
+        args:
+        - --descriptor={{ .MountPath }}/{{ .DescriptorKey }}
+        - --routes={{ .RoutesMountPath }}/routes.json
+        - --grpc-server-endpoint={{ .Upstream }}
+        - --http-port=8080
+        ports:
+        - containerPort: 8080
+        volumeMounts:
+        - name: descriptor
+          mountPath: {{ .MountPath }}
+        - name: routes
+          mountPath: {{ .RoutesMountPath }}
+      volumes:
+      {{ if gt (len .ConfigMaps) 1 -}}
+      - name: descriptor-parts
+        projected:
+          sources:
+          {{ range .ConfigMaps }}- configMap:
+              name: {{ .Name }}
+              items:
+              - key: {{ $.DescriptorKey }}
+                path: part-{{ .Index }}.pb
+          {{ end -}}
+      - name: descriptor
+        emptyDir: {}
+      {{ else -}}
+      - name: descriptor
+        configMap:
+          name: {{ (index .ConfigMaps 0).Name }}
+      {{ end -}}
+      - name: routes
+        configMap:
+          name: {{ .ServiceName }}-routes
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{ .ServiceName }}-grpc-gateway
+spec:
+  selector:
+    app: {{ .ServiceName }}-grpc-gateway
+  ports:
+  - port: 80
+    targetPort: 8080
+---
+`))
+
+// indentLines prefixes every non-empty line of s with n spaces, for embedding multi-line values (like the
+// routes.json ConfigMap data above) under a YAML block scalar.
+func indentLines(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		if l != "" {
+			lines[i] = pad + l
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
 // k8s CRDs only a megabyte of data; descriptors can be larger than this, and if they are they cannot be delivered.
 const megabyte = 1000000
 
+// maxConfigMapEncodedBytes leaves headroom under the same etcd object-size ceiling for the ConfigMap envelope
+// (name, labels, the binaryData key itself) so a full-size chunk still fits. This bounds the base64-encoded
+// size of binaryData, not the raw chunk size that gets encoded into it -- see maxConfigMapChunkBytes.
+const maxConfigMapEncodedBytes = megabyte - 4096
+
+// maxConfigMapChunkBytes is the largest raw (pre-base64) chunk size that still fits under
+// maxConfigMapEncodedBytes once encoded: base64 inflates every 3 raw bytes into 4 encoded bytes.
+const maxConfigMapChunkBytes = maxConfigMapEncodedBytes * 3 / 4
+
+// descriptorConfigMapKey is the well-known binaryData key the descriptor bytes are stored under.
+const descriptorConfigMapKey = "descriptor.pb"
+
+// descriptorMountPath is where the generated ConfigMap volumes are mounted in the sidecar container.
+const descriptorMountPath = "/etc/istio/grpc-transcoder"
+
+// Supported values for --output-mode.
+const (
+	outputModeEnvoyFilter = "envoyfilter"
+	outputModeConfigMap   = "configmap"
+	outputModeGRPCGateway = "grpc-gateway"
+)
+
+// routesConfigMapMountPath is where the derived HTTP route bindings are mounted in the grpc-gateway proxy container.
+const routesConfigMapMountPath = "/etc/istio/grpc-transcoder/routes"
+
+// defaultGRPCGatewayImage is a placeholder; operators are expected to supply --grpc-gateway-image pointing at an
+// image that understands the --descriptor/--routes flags this tool generates args for.
+const defaultGRPCGatewayImage = "grpc-gateway-proxy:latest"
+
+// httpMethodFieldNumbers maps google.api.HttpRule's method-pattern field numbers to the HTTP method they bind.
+var httpMethodFieldNumbers = map[int]string{
+	2: "GET",
+	3: "PUT",
+	4: "POST",
+	5: "DELETE",
+	6: "PATCH",
+}
+
+// googleAPIHTTPExtensionField is the field number of the google.api.http MethodOptions extension.
+const googleAPIHTTPExtensionField = 72295728
+
+// httpRuleBodyField is the field number of HttpRule.body.
+const httpRuleBodyField = 7
+
+// httpRoute is one derived HTTP/JSON <-> gRPC method binding.
+type httpRoute struct {
+	Method     string `json:"method"`         // fully qualified rpc, e.g. "pkg.Svc.Method"
+	HTTPMethod string `json:"httpMethod"`     // GET, POST, ...
+	Path       string `json:"path"`           // e.g. "/v1/{name=widgets/*}"
+	Body       string `json:"body,omitempty"` // the "body" field in the google.api.http annotation, if set
+}
+
+// parseProtoFields does a minimal protobuf wire-format scan of b, returning the raw bytes of the last
+// length-delimited (wire type 2) value seen for each field number. It understands just enough of the wire
+// format to skip over varint/fixed32/fixed64 fields it doesn't care about; it bails out (returning whatever
+// it has so far) on anything else, such as group-encoded fields.
+func parseProtoFields(b []byte) map[int][]byte {
+	out := map[int][]byte{}
+	for len(b) > 0 {
+		tag, n := protobufUvarint(b)
+		if n <= 0 {
+			return out
+		}
+		b = b[n:]
+		fieldNum := int(tag >> 3)
+		switch tag & 0x7 {
+		case 0: // varint
+			_, n := protobufUvarint(b)
+			if n <= 0 {
+				return out
+			}
+			b = b[n:]
+		case 1: // fixed64
+			if len(b) < 8 {
+				return out
+			}
+			b = b[8:]
+		case 2: // length-delimited
+			l, n := protobufUvarint(b)
+			if n <= 0 || uint64(len(b[n:])) < l {
+				return out
+			}
+			b = b[n:]
+			out[fieldNum] = b[:l]
+			b = b[l:]
+		case 5: // fixed32
+			if len(b) < 4 {
+				return out
+			}
+			b = b[4:]
+		default:
+			return out
+		}
+	}
+	return out
+}
+
+// protobufUvarint decodes a protobuf base-128 varint from the start of b, returning the value and the
+// number of bytes consumed (0 on error, mirroring encoding/binary.Uvarint).
+func protobufUvarint(b []byte) (uint64, int) {
+	var x uint64
+	for i, c := range b {
+		if i >= 10 {
+			return 0, 0
+		}
+		x |= uint64(c&0x7f) << (7 * uint(i))
+		if c < 0x80 {
+			return x, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// extractHTTPRule looks for the google.api.http extension among a MethodOptions' unrecognized fields and,
+// if present, returns the first get/put/post/delete/patch binding it declares.
+func extractHTTPRule(mo *descriptor.MethodOptions) (httpMethod, path, body string, ok bool) {
+	if mo == nil {
+		return "", "", "", false
+	}
+	top := parseProtoFields(mo.ProtoReflect().GetUnknown())
+	raw, found := top[googleAPIHTTPExtensionField]
+	if !found {
+		return "", "", "", false
+	}
+	rule := parseProtoFields(raw)
+	for field, method := range httpMethodFieldNumbers {
+		if p, ok := rule[field]; ok {
+			if b, ok := rule[httpRuleBodyField]; ok {
+				body = string(b)
+			}
+			return method, string(p), body, true
+		}
+	}
+	return "", "", "", false
+}
+
+// extractHTTPRoutes derives one httpRoute per method of every service in wantServices (fully-qualified
+// "package.Service" names, as returned by getServices), falling back to the transcoder's default
+// POST /package.Service/Method mapping for methods without a google.api.http annotation.
+func extractHTTPRoutes(descriptorBytes []byte, wantServices []string) ([]httpRoute, error) {
+	var fds descriptor.FileDescriptorSet
+	if err := proto.Unmarshal(descriptorBytes, &fds); err != nil {
+		return nil, errors.Wrap(err, "error proto unmarshalling to FileDescriptorSet")
+	}
+	want := map[string]bool{}
+	for _, s := range wantServices {
+		want[s] = true
+	}
+
+	routes := []httpRoute{}
+	for _, f := range fds.GetFile() {
+		for _, svc := range f.GetService() {
+			fqsn := fmt.Sprintf("%s.%s", f.GetPackage(), svc.GetName())
+			if !want[fqsn] {
+				continue
+			}
+			for _, m := range svc.GetMethod() {
+				fqmn := fmt.Sprintf("%s.%s", fqsn, m.GetName())
+				if httpMethod, path, body, ok := extractHTTPRule(m.GetOptions()); ok {
+					routes = append(routes, httpRoute{Method: fqmn, HTTPMethod: httpMethod, Path: path, Body: body})
+				} else {
+					routes = append(routes, httpRoute{Method: fqmn, HTTPMethod: "POST", Path: fmt.Sprintf("/%s/%s", fqsn, m.GetName())})
+				}
+			}
+		}
+	}
+	return routes, nil
+}
+
+// configMapChunk is a single ConfigMap's worth of (possibly chunked) descriptor bytes.
+type configMapChunk struct {
+	Name string
+	Data string // base64-encoded, as required by the ConfigMap binaryData field
+
+	// Index is this chunk's position, zero-padded to a fixed width so that lexicographic ordering (as used
+	// by, e.g., a shell glob reassembling the chunks) matches numeric ordering. Empty when there is only one
+	// chunk.
+	Index string
+}
+
+// splitDescriptor splits b into chunks no larger than chunkSize bytes each. A descriptor that fits in a
+// single ConfigMap yields exactly one chunk.
+func splitDescriptor(b []byte, chunkSize int) [][]byte {
+	var chunks [][]byte
+	for len(b) > 0 {
+		n := chunkSize
+		if n > len(b) {
+			n = len(b)
+		}
+		chunks = append(chunks, b[:n])
+		b = b[n:]
+	}
+	if len(chunks) == 0 {
+		chunks = append(chunks, []byte{})
+	}
+	return chunks
+}
+
+// newConfigMapChunks names and base64-encodes each chunk of descriptorBytes for use as ConfigMaps; when the
+// descriptor fits a single ConfigMap there is exactly one entry, named "<service>-descriptor".
+func newConfigMapChunks(service string, descriptorBytes []byte) []configMapChunk {
+	rawChunks := splitDescriptor(descriptorBytes, maxConfigMapChunkBytes)
+	if len(rawChunks) == 1 {
+		return []configMapChunk{{
+			Name: fmt.Sprintf("%s-descriptor", service),
+			Data: base64.StdEncoding.EncodeToString(rawChunks[0]),
+		}}
+	}
+	width := len(fmt.Sprintf("%d", len(rawChunks)-1))
+	out := make([]configMapChunk, len(rawChunks))
+	for i, c := range rawChunks {
+		index := fmt.Sprintf("%0*d", width, i)
+		out[i] = configMapChunk{
+			Name:  fmt.Sprintf("%s-descriptor-%s", service, index),
+			Data:  base64.StdEncoding.EncodeToString(c),
+			Index: index,
+		}
+	}
+	return out
+}
+
 // getServices returns a list of matching services found in matching packages
 func getServices(b *[]byte, packages []string, services []string) ([]string, error) {
 	var (
@@ -135,54 +571,465 @@ func getServices(b *[]byte, packages []string, services []string) ([]string, err
 	return out, errs
 }
 
+// reflectionOptions configures how fetchDescriptorFromReflection dials the remote server.
+type reflectionOptions struct {
+	addr      string
+	useTLS    bool
+	caFile    string
+	authority string
+}
+
+// dialReflection opens a grpc.ClientConn to opts.addr, optionally over TLS with a custom CA (e.g. the mesh's
+// own root of trust) and overriding the :authority pseudo-header (useful when reflecting through a gateway
+// that routes on SNI/host rather than on the dialed address).
+func dialReflection(ctx context.Context, opts reflectionOptions) (*grpc.ClientConn, error) {
+	dialOpts := []grpc.DialOption{grpc.WithBlock()}
+	if opts.useTLS {
+		tlsConfig := &tls.Config{}
+		if opts.caFile != "" {
+			caBytes, err := ioutil.ReadFile(opts.caFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error reading --reflect-ca %q", opts.caFile)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caBytes) {
+				return nil, fmt.Errorf("no certificates found in --reflect-ca %q", opts.caFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if opts.authority != "" {
+			tlsConfig.ServerName = opts.authority
+		}
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
+	}
+	if opts.authority != "" {
+		dialOpts = append(dialOpts, grpc.WithAuthority(opts.authority))
+	}
+	return grpc.DialContext(ctx, opts.addr, dialOpts...)
+}
+
+// fetchDescriptorFromReflection connects to a live gRPC server exposing grpc.reflection.v1alpha.ServerReflection,
+// enumerates its services, and assembles their transitive file descriptors into a marshaled
+// descriptor.FileDescriptorSet, just as if it had been compiled to a descriptor file on disk.
+func fetchDescriptorFromReflection(ctx context.Context, opts reflectionOptions) ([]byte, error) {
+	conn, err := dialReflection(ctx, opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error dialing reflection endpoint %q", opts.addr)
+	}
+	defer conn.Close()
+
+	if opts.authority != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, ":authority", opts.authority)
+	}
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error opening ServerReflectionInfo stream to %q", opts.addr)
+	}
+
+	ask := func(req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+		if err := stream.Send(req); err != nil {
+			return nil, err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if errResp := resp.GetErrorResponse(); errResp != nil {
+			return nil, fmt.Errorf("reflection error %d: %s", errResp.GetErrorCode(), errResp.GetErrorMessage())
+		}
+		return resp, nil
+	}
+
+	listResp, err := ask(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_ListServices{}})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing services via reflection")
+	}
+
+	seen := map[string]*descriptor.FileDescriptorProto{}
+	var order []string
+
+	// addFile unmarshals and records a FileDescriptorProto, returning its (possibly already-known) dependencies.
+	addFile := func(raw []byte) ([]string, error) {
+		fdp := &descriptor.FileDescriptorProto{}
+		if err := proto.Unmarshal(raw, fdp); err != nil {
+			return nil, errors.Wrap(err, "error unmarshalling FileDescriptorProto from reflection")
+		}
+		if _, ok := seen[fdp.GetName()]; !ok {
+			seen[fdp.GetName()] = fdp
+			order = append(order, fdp.GetName())
+		}
+		return fdp.GetDependency(), nil
+	}
+
+	// fetchByName transitively resolves filename (and its dependencies) via FileByFilename.
+	var fetchByName func(name string) error
+	fetchByName = func(name string) error {
+		if _, ok := seen[name]; ok {
+			return nil
+		}
+		resp, err := ask(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: name}})
+		if err != nil {
+			return errors.Wrapf(err, "error resolving dependency %q via reflection", name)
+		}
+		fdps := resp.GetFileDescriptorResponse().GetFileDescriptorProto()
+		if len(fdps) == 0 {
+			return errors.Errorf("reflection server returned no file descriptor for dependency %q", name)
+		}
+		deps, err := addFile(fdps[0])
+		if err != nil {
+			return err
+		}
+		for _, d := range deps {
+			if err := fetchByName(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, svc := range listResp.GetListServicesResponse().GetService() {
+		resp, err := ask(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: svc.GetName()}})
+		if err != nil {
+			return nil, errors.Wrapf(err, "error resolving service %q via reflection", svc.GetName())
+		}
+		for _, raw := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			deps, err := addFile(raw)
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range deps {
+				if err := fetchByName(d); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	fds := &descriptor.FileDescriptorSet{}
+	for _, name := range order {
+		fds.File = append(fds.File, seen[name])
+	}
+	return proto.Marshal(fds)
+}
+
+// contextSidecarInbound and contextGateway are the --context flag values; they map to the EnvoyFilter
+// match.context values SIDECAR_INBOUND and GATEWAY respectively.
+const (
+	contextSidecarInbound = "sidecar-inbound"
+	contextGateway        = "gateway"
+)
+
+// contextLabel maps a --context flag value to the EnvoyFilter match.context it renders as.
+func contextLabel(c string) (string, error) {
+	switch c {
+	case "", contextSidecarInbound:
+		return "SIDECAR_INBOUND", nil
+	case contextGateway:
+		return "GATEWAY", nil
+	default:
+		return "", fmt.Errorf("invalid context %q; must be %q or %q", c, contextSidecarInbound, contextGateway)
+	}
+}
+
+// configEntry is one workload's worth of generation parameters, as read from a single entry of --config's
+// YAML document, or built from the single-workload CLI flags outside of --config. An empty Context is
+// treated as sidecar-inbound.
+type configEntry struct {
+	Name             string            `yaml:"name"`
+	WorkloadSelector map[string]string `yaml:"workloadSelector"`
+	Port             int               `yaml:"port"`
+	Packages         []string          `yaml:"packages"`
+	Services         []string          `yaml:"services"`
+	Context          string            `yaml:"context"`
+	// Host is required when context is "gateway". It is advisory only: EnvoyFilter's HTTP_FILTER patches
+	// cannot themselves be scoped to a virtual host, so the generated filter actually transcodes traffic for
+	// every virtual host on the matched gateway listener, not just Host. It is recorded in the generated YAML
+	// (and surfaced there as a comment) so operators know which host the filter was intended for.
+	Host            string            `yaml:"host"`
+	GatewaySelector map[string]string `yaml:"gatewaySelector"` // required when context is "gateway"
+}
+
+// configFile is the document shape accepted by --config.
+type configFile struct {
+	Entries []configEntry `yaml:"entries"`
+}
+
+// workloadEntry is a configEntry resolved to the concrete values the templates render: the context already
+// mapped to its EnvoyFilter match.context value, and the selector already resolved to whichever of
+// WorkloadSelector/GatewaySelector applies.
+type workloadEntry struct {
+	Name           string
+	SelectorLabels map[string]string
+	Port           int
+	Packages       []string
+	Services       []string
+	ContextLabel   string
+	Host           string
+}
+
+func (e configEntry) resolve() (workloadEntry, error) {
+	label, err := contextLabel(e.Context)
+	if err != nil {
+		return workloadEntry{}, errors.Wrapf(err, "entry %q", e.Name)
+	}
+	selector := e.WorkloadSelector
+	if label == "GATEWAY" {
+		if e.Host == "" {
+			return workloadEntry{}, fmt.Errorf("entry %q: --host (or host:) is required when context is %q", e.Name, contextGateway)
+		}
+		if len(e.GatewaySelector) == 0 {
+			return workloadEntry{}, fmt.Errorf("entry %q: --gateway-selector (or gatewaySelector:) is required when context is %q", e.Name, contextGateway)
+		}
+		selector = e.GatewaySelector
+	}
+	return workloadEntry{
+		Name:           e.Name,
+		SelectorLabels: selector,
+		Port:           e.Port,
+		Packages:       e.Packages,
+		Services:       e.Services,
+		ContextLabel:   label,
+		Host:           e.Host,
+	}, nil
+}
+
+// transcoderOptions are the grpc_json_transcoder settings shared by every workload in a single invocation,
+// whether there's one (from flags) or several (from --config).
+type transcoderOptions struct {
+	outputMode                   string
+	addWhiteSpace                bool
+	convertGRPCStatus            bool
+	preserveProtoFieldNames      bool
+	printEnumsAsInts             bool
+	alwaysPrintPrimitiveFields   bool
+	autoMapping                  bool
+	matchIncomingRequestRoute    bool
+	ignoreUnknownQueryParameters bool
+	ignoredQueryParameters       []string
+	maxRequestBodySize           int
+	maxResponseBodySize          int
+	grpcGatewayImage             string
+}
+
+// renderWorkload renders one EnvoyFilter (plus, in configmap mode, its ConfigMaps) for entry to w; in
+// grpc-gateway mode it renders the proxy's ConfigMaps, Deployment and Service instead of an EnvoyFilter.
+func renderWorkload(w io.Writer, entry workloadEntry, descriptorBytes []byte, opts transcoderOptions) error {
+	if opts.autoMapping && len(entry.Services) > 0 {
+		return fmt.Errorf("entry %q: --auto-mapping and --services are incompatible: auto_mapping implies the "+
+			"transcoder derives HTTP routes for all services already selected via --packages", entry.Name)
+	}
+
+	protoServices, err := getServices(&descriptorBytes, entry.Packages, entry.Services)
+	if err != nil {
+		return errors.Wrapf(err, "error extracting services from descriptor for entry %q", entry.Name)
+	}
+	sort.Strings(protoServices)
+
+	params := map[string]interface{}{
+		"ServiceName":                  entry.Name,
+		"PortNumber":                   entry.Port,
+		"SelectorLabels":               entry.SelectorLabels,
+		"Context":                      entry.ContextLabel,
+		"Host":                         entry.Host,
+		"ProtoServices":                protoServices,
+		"AddWhiteSpace":                opts.addWhiteSpace,
+		"ConvertGRPCStatus":            opts.convertGRPCStatus,
+		"PreserveProtoFieldNames":      opts.preserveProtoFieldNames,
+		"PrintEnumsAsInts":             opts.printEnumsAsInts,
+		"AlwaysPrintPrimitiveFields":   opts.alwaysPrintPrimitiveFields,
+		"AutoMapping":                  opts.autoMapping,
+		"MatchIncomingRequestRoute":    opts.matchIncomingRequestRoute,
+		"IgnoreUnknownQueryParameters": opts.ignoreUnknownQueryParameters,
+		"IgnoredQueryParameters":       opts.ignoredQueryParameters,
+		"MaxRequestBodySize":           opts.maxRequestBodySize,
+		"MaxResponseBodySize":          opts.maxResponseBodySize,
+	}
+
+	if opts.outputMode == outputModeGRPCGateway {
+		routes, err := extractHTTPRoutes(descriptorBytes, protoServices)
+		if err != nil {
+			return errors.Wrapf(err, "error deriving HTTP routes for entry %q", entry.Name)
+		}
+		routesJSON, err := json.MarshalIndent(routes, "", "  ")
+		if err != nil {
+			return errors.Wrapf(err, "error marshalling routes for entry %q", entry.Name)
+		}
+		params["ConfigMaps"] = newConfigMapChunks(entry.Name, descriptorBytes)
+		params["DescriptorKey"] = descriptorConfigMapKey
+		params["MountPath"] = descriptorMountPath
+		params["RoutesMountPath"] = routesConfigMapMountPath
+		params["RoutesJSON"] = string(routesJSON)
+		params["Image"] = opts.grpcGatewayImage
+		params["Upstream"] = fmt.Sprintf("%s:%d", entry.Name, entry.Port)
+		return grpcGatewayTmpl.Execute(w, params)
+	}
+
+	if opts.outputMode == outputModeConfigMap {
+		params["ConfigMaps"] = newConfigMapChunks(entry.Name, descriptorBytes)
+		params["DescriptorKey"] = descriptorConfigMapKey
+		params["MountPath"] = descriptorMountPath
+		return configMapTmpl.Execute(w, params)
+	}
+
+	if len(descriptorBytes) > megabyte {
+		return fmt.Errorf("descriptor file is too large (%d bytes); CRDs cannot be larger than a megabyte; "+
+			"use --output-mode %s instead", len(descriptorBytes), outputModeConfigMap)
+	}
+	params["DescriptorBinary"] = base64.StdEncoding.EncodeToString(descriptorBytes)
+	return tmpl.Execute(w, params)
+}
+
+// parseKeyValuePairs parses a "k=v,k2=v2" style --foo-selector flag into a label map.
+func parseKeyValuePairs(pairs []string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid key=value pair %q", p)
+		}
+		out[kv[0]] = kv[1]
+	}
+	return out, nil
+}
+
 func main() {
 	var (
 		service            string
 		packages           []string
 		services           []string
-		protoServices      []string
 		descriptorFilePath string
 		port               int
 		addWhiteSpace      bool
 		converGRPCStatus   bool
+		outputMode         string
+		reflectAddr        string
+		reflectTLS         bool
+		reflectCA          string
+		reflectAuthority   string
+		reflectTimeout     time.Duration
+
+		preserveProtoFieldNames    bool
+		printEnumsAsInts           bool
+		alwaysPrintPrimitiveFields bool
+		autoMapping                bool
+		matchIncomingRequestRoute  bool
+		ignoreUnknownQueryParams   bool
+		ignoredQueryParameters     []string
+		maxRequestBodySize         int
+		maxResponseBodySize        int
+
+		configPath       string
+		cliContext       string
+		host             string
+		gatewaySelector  []string
+		grpcGatewayImage string
 	)
 
 	cmd := &cobra.Command{
 		Short:   "gen-transcoder",
 		Example: "gen-transcoder [--port 80] [--service foo] [--packages acme.example] [--services 'http.*,echo.*'] --descriptor /path/to/descriptor",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if _, err := os.Stat(descriptorFilePath); os.IsNotExist(err) {
-				log.Printf("error opening descriptor file %q\n", descriptorFilePath)
-				return err
+			if outputMode != outputModeEnvoyFilter && outputMode != outputModeConfigMap && outputMode != outputModeGRPCGateway {
+				return fmt.Errorf("invalid --output-mode %q; must be %q, %q or %q", outputMode, outputModeEnvoyFilter, outputModeConfigMap, outputModeGRPCGateway)
 			}
 
-			descriptorBytes, err := ioutil.ReadFile(descriptorFilePath)
-			if err != nil {
-				log.Printf("error reading descriptor file %q\n", descriptorFilePath)
-				return err
+			if descriptorFilePath != "" && reflectAddr != "" {
+				return fmt.Errorf("--descriptor and --reflect are mutually exclusive")
 			}
-			// TODO: support outputting a file based CRD when descriptor is too large.
-			if len(descriptorBytes) > megabyte {
-				return fmt.Errorf("descriptor file is too large (%d bytes); CRDs cannot be larger than a megabyte", len(descriptorBytes))
+			if descriptorFilePath == "" && reflectAddr == "" {
+				return fmt.Errorf("one of --descriptor or --reflect is required")
 			}
 
-			protoServices, err = getServices(&descriptorBytes, packages, services)
-			if err != nil {
-				log.Printf("error extracting services from descriptor: %v\n", err)
-				return err
+			var entries []configEntry
+			if configPath != "" {
+				raw, err := ioutil.ReadFile(configPath)
+				if err != nil {
+					log.Printf("error reading --config %q\n", configPath)
+					return err
+				}
+				var cf configFile
+				if err := yaml.Unmarshal(raw, &cf); err != nil {
+					return errors.Wrapf(err, "error parsing --config %q", configPath)
+				}
+				entries = cf.Entries
+			} else {
+				gwSelector, err := parseKeyValuePairs(gatewaySelector)
+				if err != nil {
+					return errors.Wrap(err, "error parsing --gateway-selector")
+				}
+				entries = []configEntry{{
+					Name:             service,
+					WorkloadSelector: map[string]string{"app": service},
+					Port:             port,
+					Packages:         packages,
+					Services:         services,
+					Context:          cliContext,
+					Host:             host,
+					GatewaySelector:  gwSelector,
+				}}
+			}
+
+			workloads := make([]workloadEntry, 0, len(entries))
+			for _, e := range entries {
+				w, err := e.resolve()
+				if err != nil {
+					return err
+				}
+				workloads = append(workloads, w)
+			}
+
+			var descriptorBytes []byte
+			var err error
+			if reflectAddr != "" {
+				ctx, cancel := context.WithTimeout(context.Background(), reflectTimeout)
+				defer cancel()
+				descriptorBytes, err = fetchDescriptorFromReflection(ctx, reflectionOptions{
+					addr:      reflectAddr,
+					useTLS:    reflectTLS,
+					caFile:    reflectCA,
+					authority: reflectAuthority,
+				})
+				if err != nil {
+					log.Printf("error fetching descriptor via reflection from %q\n", reflectAddr)
+					return err
+				}
+			} else {
+				if _, err := os.Stat(descriptorFilePath); os.IsNotExist(err) {
+					log.Printf("error opening descriptor file %q\n", descriptorFilePath)
+					return err
+				}
+
+				descriptorBytes, err = ioutil.ReadFile(descriptorFilePath)
+				if err != nil {
+					log.Printf("error reading descriptor file %q\n", descriptorFilePath)
+					return err
+				}
+			}
+
+			opts := transcoderOptions{
+				outputMode:                   outputMode,
+				addWhiteSpace:                addWhiteSpace,
+				convertGRPCStatus:            converGRPCStatus,
+				preserveProtoFieldNames:      preserveProtoFieldNames,
+				printEnumsAsInts:             printEnumsAsInts,
+				alwaysPrintPrimitiveFields:   alwaysPrintPrimitiveFields,
+				autoMapping:                  autoMapping,
+				matchIncomingRequestRoute:    matchIncomingRequestRoute,
+				ignoreUnknownQueryParameters: ignoreUnknownQueryParams,
+				ignoredQueryParameters:       ignoredQueryParameters,
+				maxRequestBodySize:           maxRequestBodySize,
+				maxResponseBodySize:          maxResponseBodySize,
+				grpcGatewayImage:             grpcGatewayImage,
 			}
-			sort.Strings(protoServices)
 
-			encoded := base64.StdEncoding.EncodeToString(descriptorBytes)
-			params := map[string]interface{}{
-				"ServiceName":       service,
-				"PortNumber":        port,
-				"DescriptorBinary":  encoded,
-				"ProtoServices":     protoServices,
-				"AddWhiteSpace":     addWhiteSpace,
-				"ConvertGRPCStatus": converGRPCStatus,
+			for _, w := range workloads {
+				if err := renderWorkload(os.Stdout, w, descriptorBytes, opts); err != nil {
+					return err
+				}
 			}
-			return tmpl.Execute(os.Stdout, params)
+			return nil
 		},
 	}
 
@@ -194,8 +1041,57 @@ func main() {
 	cmd.PersistentFlags().StringSliceVar(&services, "services", []string{},
 		"Comma separated list of the proto service names contained in the descriptor files. These must be fully qualified names, i.e. package_name.service_name")
 	cmd.PersistentFlags().StringVarP(&descriptorFilePath, "descriptor", "d", "", "Location of proto descriptor files relative to the server.")
+	cmd.PersistentFlags().StringVar(&reflectAddr, "reflect", "",
+		"host:port of a running gRPC server exposing grpc.reflection.v1alpha.ServerReflection to source the descriptor "+
+			"from, instead of --descriptor. Mutually exclusive with --descriptor.")
+	cmd.PersistentFlags().BoolVar(&reflectTLS, "reflect-tls", false, "Use TLS when connecting to --reflect.")
+	cmd.PersistentFlags().StringVar(&reflectCA, "reflect-ca", "", "PEM-encoded CA bundle to verify the --reflect server's certificate, if it isn't signed by a public CA.")
+	cmd.PersistentFlags().StringVar(&reflectAuthority, "reflect-authority", "",
+		"Override the :authority pseudo-header sent to --reflect, e.g. when reflecting through a mesh gateway that routes on it.")
+	cmd.PersistentFlags().DurationVar(&reflectTimeout, "reflect-timeout", 10*time.Second,
+		"How long to wait for --reflect to dial and respond before giving up.")
+	cmd.PersistentFlags().StringVar(&configPath, "config", "",
+		"Path to a YAML file with an `entries` list, each describing one workload's (workloadSelector, port, packages, services, "+
+			"context) to generate output for; emits one entry's documents (an EnvoyFilter, or with --output-mode=grpc-gateway a "+
+			"proxy Deployment and Service) per entry instead of the single set described by the other flags.")
+	cmd.PersistentFlags().StringVar(&cliContext, "context", contextSidecarInbound,
+		fmt.Sprintf("Where the filter applies: %q (the default) patches the workload's inbound sidecar listener; %q patches an "+
+			"ingress gateway's listener instead, attached via --gateway-selector (see --host). Ignored when --config is set.",
+			contextSidecarInbound, contextGateway))
+	cmd.PersistentFlags().StringVar(&host, "host", "",
+		"The virtual host this filter is intended for. Required when --context=gateway. Advisory only: EnvoyFilter's "+
+			"HTTP_FILTER patches cannot themselves be scoped to a virtual host, so the generated filter actually "+
+			"transcodes traffic for every virtual host on the matched gateway listener, not just this one.")
+	cmd.PersistentFlags().StringSliceVar(&gatewaySelector, "gateway-selector", []string{},
+		"Comma separated key=value workloadSelector labels for the ingress gateway to attach to. Required when --context=gateway.")
 	cmd.PersistentFlags().BoolVarP(&addWhiteSpace, "add_whitespace", "w", true, "JSON pretty print.")
 	cmd.PersistentFlags().BoolVarP(&converGRPCStatus, "convert_grpc_status", "c", true, "Convert gRPC status to JSON.")
+	cmd.PersistentFlags().StringVar(&outputMode, "output-mode", outputModeEnvoyFilter,
+		"Output format: \"envoyfilter\" inlines the descriptor as base64 in the EnvoyFilter (fails over a megabyte); "+
+			"\"configmap\" ships the descriptor as one or more ConfigMaps mounted into the sidecar instead, for "+
+			"descriptors too large to inline; \"grpc-gateway\" instead generates a standalone grpc-gateway reverse "+
+			"proxy Deployment and Service, for meshes that can't rely on Envoy's grpc_json_transcoder filter.")
+	cmd.PersistentFlags().StringVar(&grpcGatewayImage, "grpc-gateway-image", defaultGRPCGatewayImage,
+		"Image to run for the proxy container in --output-mode=grpc-gateway's Deployment; must accept --descriptor, "+
+			"--routes, --grpc-server-endpoint and --http-port flags matching the ones this tool generates.")
+	cmd.PersistentFlags().BoolVar(&preserveProtoFieldNames, "preserve-proto-field-names", false,
+		"print_options.preserve_proto_field_names: use the original proto field name (rather than camelCase) in JSON output.")
+	cmd.PersistentFlags().BoolVar(&printEnumsAsInts, "print-enums-as-ints", false,
+		"print_options.always_print_enums_as_ints: render enum values as their numeric value instead of their name.")
+	cmd.PersistentFlags().BoolVar(&alwaysPrintPrimitiveFields, "always-print-primitive-fields", true,
+		"print_options.always_print_primitive_fields: include fields with default values in JSON output.")
+	cmd.PersistentFlags().BoolVar(&autoMapping, "auto-mapping", false,
+		"auto_mapping: derive HTTP routes for every method of the selected services that has no google.api.http annotation. Incompatible with --services.")
+	cmd.PersistentFlags().BoolVar(&matchIncomingRequestRoute, "match-incoming-request-route", true,
+		"match_incoming_request_route: take the route matched by RDS into account when deciding whether to transcode a request.")
+	cmd.PersistentFlags().BoolVar(&ignoreUnknownQueryParams, "ignore-unknown-query-parameters", true,
+		"ignore_unknown_query_parameters: do not error on query parameters that don't map to a proto field.")
+	cmd.PersistentFlags().StringSliceVar(&ignoredQueryParameters, "ignored-query-parameters", []string{},
+		"ignored_query_parameters: comma separated list of query parameter names the transcoder should never attempt to map to proto fields.")
+	cmd.PersistentFlags().IntVar(&maxRequestBodySize, "max-request-body-size", 0,
+		"max_request_body_size: maximum request body size in bytes the transcoder will buffer, 0 for the transcoder's default.")
+	cmd.PersistentFlags().IntVar(&maxResponseBodySize, "max-response-body-size", 0,
+		"max_response_body_size: maximum response body size in bytes the transcoder will buffer, 0 for the transcoder's default.")
 
 	if err := cmd.Execute(); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,184 @@
+// Copyright 2018 Tetrate.io, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	descriptor "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+func TestSplitDescriptor(t *testing.T) {
+	b := make([]byte, 10)
+	chunks := splitDescriptor(b, 3)
+	if len(chunks) != 4 {
+		t.Fatalf("got %d chunks, want 4", len(chunks))
+	}
+	for i, c := range chunks[:3] {
+		if len(c) != 3 {
+			t.Errorf("chunk %d has %d bytes, want 3", i, len(c))
+		}
+	}
+	if len(chunks[3]) != 1 {
+		t.Errorf("last chunk has %d bytes, want 1", len(chunks[3]))
+	}
+
+	if got := splitDescriptor([]byte{}, 3); len(got) != 1 || len(got[0]) != 0 {
+		t.Errorf("splitDescriptor of empty input = %v, want a single empty chunk", got)
+	}
+}
+
+func TestNewConfigMapChunksOrdering(t *testing.T) {
+	// 12 chunks forces a two-digit index; part-10 must sort after part-9 lexicographically once padded.
+	chunks := newConfigMapChunks("svc", make([]byte, maxConfigMapChunkBytes*11+1))
+	if len(chunks) != 12 {
+		t.Fatalf("got %d chunks, want 12", len(chunks))
+	}
+	indices := make([]string, len(chunks))
+	for i, c := range chunks {
+		indices[i] = c.Index
+	}
+	for i := 1; i < len(indices); i++ {
+		if indices[i-1] >= indices[i] {
+			t.Fatalf("chunk indices not in lexicographic order: %v", indices)
+		}
+	}
+	if indices[0] != "00" || indices[len(indices)-1] != "11" {
+		t.Errorf("unexpected zero-padding: first=%q last=%q", indices[0], indices[len(indices)-1])
+	}
+}
+
+func TestNewConfigMapChunksSingle(t *testing.T) {
+	chunks := newConfigMapChunks("svc", []byte("abc"))
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1", len(chunks))
+	}
+	if chunks[0].Name != "svc-descriptor" {
+		t.Errorf("single chunk name = %q, want %q", chunks[0].Name, "svc-descriptor")
+	}
+	if chunks[0].Index != "" {
+		t.Errorf("single chunk index = %q, want empty", chunks[0].Index)
+	}
+}
+
+func TestNewConfigMapChunksEncodedSizeWithinCeiling(t *testing.T) {
+	chunks := newConfigMapChunks("svc", make([]byte, maxConfigMapChunkBytes))
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1", len(chunks))
+	}
+	if len(chunks[0].Data) > maxConfigMapEncodedBytes {
+		t.Errorf("base64-encoded chunk is %d bytes, want <= %d (the etcd object-size ceiling)",
+			len(chunks[0].Data), maxConfigMapEncodedBytes)
+	}
+}
+
+func TestProtobufUvarint(t *testing.T) {
+	cases := []struct {
+		name    string
+		in      []byte
+		wantVal uint64
+		wantN   int
+	}{
+		{"single byte", []byte{0x01}, 1, 1},
+		{"two bytes", []byte{0x96, 0x01}, 150, 2},
+		{"empty", []byte{}, 0, 0},
+		{"truncated continuation", []byte{0x96}, 0, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			val, n := protobufUvarint(c.in)
+			if val != c.wantVal || n != c.wantN {
+				t.Errorf("protobufUvarint(%v) = (%d, %d), want (%d, %d)", c.in, val, n, c.wantVal, c.wantN)
+			}
+		})
+	}
+}
+
+func TestParseProtoFields(t *testing.T) {
+	// field 1: varint 1, field 2: length-delimited "hi"
+	b := []byte{0x08, 0x01, 0x12, 0x02, 'h', 'i'}
+	out := parseProtoFields(b)
+	if string(out[2]) != "hi" {
+		t.Errorf("parseProtoFields field 2 = %q, want %q", out[2], "hi")
+	}
+	if _, ok := out[1]; ok {
+		t.Errorf("parseProtoFields should not record varint fields, found field 1")
+	}
+}
+
+// encodeHTTPRule builds the raw bytes of a google.api.http MethodOptions extension with the given
+// method-pattern field/path and, if body != "", a body field.
+func encodeHTTPRule(methodField int, path, body string) []byte {
+	rule := encodeLengthDelimited(methodField, []byte(path))
+	if body != "" {
+		rule = append(rule, encodeLengthDelimited(httpRuleBodyField, []byte(body))...)
+	}
+	return encodeLengthDelimited(googleAPIHTTPExtensionField, rule)
+}
+
+func encodeLengthDelimited(field int, b []byte) []byte {
+	out := encodeVarint(uint64(field)<<3 | 2)
+	out = append(out, encodeVarint(uint64(len(b)))...)
+	return append(out, b...)
+}
+
+func encodeVarint(x uint64) []byte {
+	var out []byte
+	for x >= 0x80 {
+		out = append(out, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(out, byte(x))
+}
+
+func TestExtractHTTPRule(t *testing.T) {
+	cases := []struct {
+		name       string
+		field      int
+		path       string
+		body       string
+		wantMethod string
+		wantBody   string
+	}{
+		{"get, no body", 2, "/v1/widgets", "", "GET", ""},
+		{"post with body", 4, "/v1/widgets", "*", "POST", "*"},
+		{"patch with named body", 6, "/v1/widgets/{id}", "widget", "PATCH", "widget"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			raw := encodeHTTPRule(c.field, c.path, c.body)
+			mo := &descriptor.MethodOptions{}
+			mo.ProtoReflect().SetUnknown(raw)
+
+			method, path, body, ok := extractHTTPRule(mo)
+			if !ok {
+				t.Fatalf("extractHTTPRule returned ok=false")
+			}
+			if method != c.wantMethod || path != c.path || body != c.wantBody {
+				t.Errorf("extractHTTPRule = (%q, %q, %q), want (%q, %q, %q)",
+					method, path, body, c.wantMethod, c.path, c.wantBody)
+			}
+		})
+	}
+}
+
+func TestExtractHTTPRuleNoAnnotation(t *testing.T) {
+	if _, _, _, ok := extractHTTPRule(&descriptor.MethodOptions{}); ok {
+		t.Errorf("extractHTTPRule with no google.api.http annotation should return ok=false")
+	}
+	if _, _, _, ok := extractHTTPRule(nil); ok {
+		t.Errorf("extractHTTPRule(nil) should return ok=false")
+	}
+}